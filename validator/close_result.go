@@ -0,0 +1,83 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package validator
+
+import (
+	"github.com/offchainlabs/arb-avm/protocol"
+	"github.com/offchainlabs/arb-util/common"
+)
+
+// UnanimousCloseOutcome is the reason a unanimous closing state machine
+// reported on its retChan. Every value other than ConfirmedOnL1 is
+// terminal: the state machine stopped driving towards confirmation.
+type UnanimousCloseOutcome int
+
+const (
+	// ConfirmedOnL1 means the assertion's confirmation was observed on
+	// L1, but L1 finality (and therefore VM delivery) is still pending.
+	// It precedes Confirmed on the same retChan and is not terminal.
+	ConfirmedOnL1 UnanimousCloseOutcome = iota
+	// Confirmed means the assertion was confirmed and, once L1 finality
+	// was reached, delivered to the VM.
+	Confirmed
+	// SupersededBySequence means a newer sequence number was proposed
+	// before this one finished closing.
+	SupersededBySequence
+	// SupersededByFinal means a final unanimous assertion superseded
+	// this one before it could be confirmed.
+	SupersededByFinal
+	// Aborted means the closing attempt was abandoned outright rather
+	// than retried. Not currently emitted by any closing state; reserved
+	// for a future path that gives up instead of reverting (e.g. after
+	// repeated L1 reorgs orphan the same pending assertion).
+	Aborted
+	// Unsynchronized means an unexpected bridge event was observed,
+	// indicating the validator's view of VM state has diverged.
+	Unsynchronized
+)
+
+func (o UnanimousCloseOutcome) String() string {
+	switch o {
+	case ConfirmedOnL1:
+		return "ConfirmedOnL1"
+	case Confirmed:
+		return "Confirmed"
+	case SupersededBySequence:
+		return "SupersededBySequence"
+	case SupersededByFinal:
+		return "SupersededByFinal"
+	case Aborted:
+		return "Aborted"
+	case Unsynchronized:
+		return "Unsynchronized"
+	default:
+		return "Unknown"
+	}
+}
+
+// UnanimousCloseResult is sent on a closing state machine's retChan for
+// each outcome it reports, terminal or not (see UnanimousCloseOutcome).
+// It replaces the bare chan<- bool that used to discard the reason for
+// failure.
+type UnanimousCloseResult struct {
+	Outcome     UnanimousCloseOutcome
+	SequenceNum uint64
+	Assertion   *protocol.Assertion
+	BlockHash   common.Hash
+	BlockNum    uint64
+	Err         error
+}
@@ -0,0 +1,39 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package validator
+
+import "testing"
+
+func TestUnanimousCloseOutcomeString(t *testing.T) {
+	cases := []struct {
+		outcome UnanimousCloseOutcome
+		want    string
+	}{
+		{ConfirmedOnL1, "ConfirmedOnL1"},
+		{Confirmed, "Confirmed"},
+		{SupersededBySequence, "SupersededBySequence"},
+		{SupersededByFinal, "SupersededByFinal"},
+		{Aborted, "Aborted"},
+		{Unsynchronized, "Unsynchronized"},
+		{UnanimousCloseOutcome(99), "Unknown"},
+	}
+	for _, tc := range cases {
+		if got := tc.outcome.String(); got != tc.want {
+			t.Errorf("%d.String() = %q, want %q", tc.outcome, got, tc.want)
+		}
+	}
+}
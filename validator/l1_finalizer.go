@@ -0,0 +1,181 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package validator
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/offchainlabs/arb-util/common"
+)
+
+// ErrBlockOrphaned is returned by L1Finalizer.IsBlockFinalized when the
+// block that was being watched has been reorged out of the canonical
+// chain, rather than simply not yet finalized.
+var ErrBlockOrphaned = errors.New("L1Finalizer: block orphaned by reorg")
+
+// L1Finalizer reports on the finality of blocks on the underlying L1
+// chain. The validator consults it before taking any action that
+// irrevocably commits VM-visible state (such as DeliverMessagesToVM) off
+// the back of a single L1 log, since a reorg can otherwise retract the
+// log that triggered the action after the fact.
+type L1Finalizer interface {
+	// IsBlockFinalized reports whether blockHash, known to have been
+	// observed at height blockNum, has been finalized and can no
+	// longer be reorged away. It returns ErrBlockOrphaned once it finds
+	// blockNum no longer occupied by blockHash in the canonical chain;
+	// beaconFinalizer only checks this for heights at or below its
+	// finalized checkpoint and reports higher ones as not finalized.
+	// Passing the height lets implementations look the block up
+	// directly instead of scanning for it, which also makes the check
+	// correct no matter how long ago blockNum was observed (e.g. after
+	// a validator restart rehydrates a pending confirmation).
+	IsBlockFinalized(blockHash common.Hash, blockNum uint64) (bool, error)
+
+	// WaitForFinality returns a channel that is closed once blockNum
+	// is finalized, or when ctx is canceled. It is a convenience
+	// helper for callers that can afford to block; the validator's
+	// own polling loop uses IsBlockFinalized directly instead.
+	WaitForFinality(ctx context.Context, blockNum uint64) <-chan struct{}
+}
+
+// trustedConfirmationsFinalizer treats a block as finalized once it has
+// accumulated a configured number of confirmations. It trusts whatever
+// the connected L1 node reports as the latest block, rather than
+// consulting a separate consensus endpoint.
+type trustedConfirmationsFinalizer struct {
+	requiredConfirmations uint64
+	latestBlockNum        func() (uint64, error)
+	blockHashAtHeight     func(height uint64) (common.Hash, error)
+}
+
+// NewTrustedConfirmationsFinalizer returns an L1Finalizer that waits for
+// requiredConfirmations blocks to be built on top of a block before
+// treating it as final. latestBlockNum and blockHashAtHeight are thin
+// wrappers around the validator's Ethereum client.
+func NewTrustedConfirmationsFinalizer(
+	requiredConfirmations uint64,
+	latestBlockNum func() (uint64, error),
+	blockHashAtHeight func(height uint64) (common.Hash, error),
+) L1Finalizer {
+	return &trustedConfirmationsFinalizer{
+		requiredConfirmations: requiredConfirmations,
+		latestBlockNum:        latestBlockNum,
+		blockHashAtHeight:     blockHashAtHeight,
+	}
+}
+
+func (f *trustedConfirmationsFinalizer) IsBlockFinalized(blockHash common.Hash, blockNum uint64) (bool, error) {
+	latest, err := f.latestBlockNum()
+	if err != nil {
+		return false, &Error{err, "trustedConfirmationsFinalizer: failed to fetch latest block"}
+	}
+	hash, err := f.blockHashAtHeight(blockNum)
+	if err != nil {
+		return false, &Error{err, "trustedConfirmationsFinalizer: failed to fetch block hash"}
+	}
+	if hash != blockHash {
+		return false, ErrBlockOrphaned
+	}
+	return latest >= blockNum+f.requiredConfirmations, nil
+}
+
+func (f *trustedConfirmationsFinalizer) WaitForFinality(ctx context.Context, blockNum uint64) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				latest, err := f.latestBlockNum()
+				if err == nil && latest >= blockNum+f.requiredConfirmations {
+					return
+				}
+			}
+		}
+	}()
+	return done
+}
+
+// beaconFinalizer treats a block as finalized once an L1 beacon/consensus
+// endpoint reports it at or below its finalized checkpoint. Unlike
+// trustedConfirmationsFinalizer this reflects true protocol finality
+// rather than a heuristic confirmation count.
+type beaconFinalizer struct {
+	finalizedBlockNum func() (uint64, error)
+	blockHashAtHeight func(height uint64) (common.Hash, error)
+}
+
+// NewBeaconFinalizer returns an L1Finalizer backed by a beacon/consensus
+// client's notion of finalized checkpoints. finalizedBlockNum should
+// return the highest L1 block number the beacon chain has finalized.
+func NewBeaconFinalizer(
+	finalizedBlockNum func() (uint64, error),
+	blockHashAtHeight func(height uint64) (common.Hash, error),
+) L1Finalizer {
+	return &beaconFinalizer{
+		finalizedBlockNum: finalizedBlockNum,
+		blockHashAtHeight: blockHashAtHeight,
+	}
+}
+
+func (f *beaconFinalizer) IsBlockFinalized(blockHash common.Hash, blockNum uint64) (bool, error) {
+	finalized, err := f.finalizedBlockNum()
+	if err != nil {
+		return false, &Error{err, "beaconFinalizer: failed to fetch finalized checkpoint"}
+	}
+	if blockNum > finalized {
+		// Not yet finalized; whether it's still pending or was reorged
+		// away can't be told from the finalized chain alone, which the
+		// caller can retry on its next poll once the checkpoint advances.
+		return false, nil
+	}
+	hash, err := f.blockHashAtHeight(blockNum)
+	if err != nil {
+		return false, &Error{err, "beaconFinalizer: failed to fetch block hash"}
+	}
+	if hash != blockHash {
+		return false, ErrBlockOrphaned
+	}
+	return true, nil
+}
+
+func (f *beaconFinalizer) WaitForFinality(ctx context.Context, blockNum uint64) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				finalized, err := f.finalizedBlockNum()
+				if err == nil && finalized >= blockNum {
+					return
+				}
+			}
+		}
+	}()
+	return done
+}
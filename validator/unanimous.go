@@ -21,6 +21,7 @@ import (
 	"github.com/offchainlabs/arb-validator/ethbridge"
 
 	"github.com/offchainlabs/arb-avm/protocol"
+	"github.com/offchainlabs/arb-util/common"
 	"github.com/offchainlabs/arb-validator/valmessage"
 )
 
@@ -28,7 +29,9 @@ type attemptingUnanimousClosing struct {
 	*validatorConfig
 	*validatorCore
 	assertion *protocol.Assertion
-	retChan   chan<- bool
+	retChan   chan<- UnanimousCloseResult
+	log       ValidatorLog
+	finalizer L1Finalizer
 }
 
 func (bot attemptingUnanimousClosing) UpdateTime(time uint64) (validatorState, []valmessage.OutgoingMessage, error) {
@@ -36,7 +39,7 @@ func (bot attemptingUnanimousClosing) UpdateTime(time uint64) (validatorState, [
 }
 
 func (bot attemptingUnanimousClosing) UpdateState(ev ethbridge.Event, time uint64) (validatorState, challengeState, []valmessage.OutgoingMessage, error) {
-	switch ev.(type) {
+	switch ev := ev.(type) {
 	case ethbridge.ProposedUnanimousAssertEvent:
 		// Someone proposed an non-final update
 		// Final update has already been sent
@@ -46,11 +49,33 @@ func (bot attemptingUnanimousClosing) UpdateState(ev ethbridge.Event, time uint6
 		// Final update has already been sent
 		return bot, nil, nil, nil
 	case ethbridge.FinalUnanimousAssertEvent:
+		next := waitingL1Finality{
+			validatorConfig: bot.validatorConfig,
+			validatorCore:   bot.validatorCore,
+			assertion:       bot.assertion,
+			blockHash:       ev.BlockId.HeaderHash,
+			blockNum:        ev.BlockId.Height.AsInt().Uint64(),
+			revert:          bot,
+			retChan:         bot.retChan,
+			log:             bot.log,
+			finalizer:       bot.finalizer,
+		}
+		if bot.log != nil {
+			pending := persistedPendingAssertion{Assertion: bot.assertion}
+			state := persistedState{Kind: stateKindWaitingL1Finality, BlockHash: next.blockHash, BlockNum: next.blockNum, RevertKind: stateKindAttemptingUnanimousClosing}
+			if err := bot.log.CommitTransition(state, &pending, nil); err != nil {
+				return nil, nil, nil, err
+			}
+		}
 		if bot.retChan != nil {
-			bot.retChan <- true
+			bot.retChan <- UnanimousCloseResult{
+				Outcome:   ConfirmedOnL1,
+				Assertion: bot.assertion,
+				BlockHash: next.blockHash,
+				BlockNum:  next.blockNum,
+			}
 		}
-		bot.validatorCore.DeliverMessagesToVM()
-		return NewWaitingObserver(bot.validatorConfig, bot.validatorCore), nil, nil, nil
+		return next, nil, nil, nil
 	default:
 		return nil, nil, nil, &Error{nil, "ERROR: waitingAssertDefender: VM state got unsynchronized"}
 	}
@@ -61,7 +86,9 @@ type attemptingOffchainClosing struct {
 	*validatorCore
 	sequenceNum uint64
 	assertion   *protocol.Assertion
-	retChan     chan<- bool
+	retChan     chan<- UnanimousCloseResult
+	log         ValidatorLog
+	finalizer   L1Finalizer
 }
 
 func (bot attemptingOffchainClosing) UpdateTime(time uint64) (validatorState, []valmessage.OutgoingMessage, error) {
@@ -76,31 +103,66 @@ func (bot attemptingOffchainClosing) UpdateState(ev ethbridge.Event, time uint64
 			// Newer update has already been sent
 			return bot, nil, nil, nil
 		} else if ev.SequenceNum > bot.sequenceNum {
+			if bot.log != nil {
+				if err := bot.log.WipePendingAssertion(); err != nil {
+					return nil, nil, nil, err
+				}
+			}
 			if bot.retChan != nil {
-				bot.retChan <- false
+				bot.retChan <- UnanimousCloseResult{
+					Outcome:     SupersededBySequence,
+					SequenceNum: ev.SequenceNum,
+					Err:         errors.New("unanimous assertion unexpectedly superseded"),
+				}
 			}
 			return nil, nil, nil, errors.New("unanimous assertion unexpectedly superseded")
 		} else {
-			return waitingOffchainClosing{
+			next := waitingOffchainClosing{
 				bot.validatorConfig,
 				bot.GetCore(),
 				bot.assertion,
 				time + bot.config.GracePeriod,
 				bot.retChan,
-			}, nil, nil, nil
+				bot.log,
+				bot.finalizer,
+			}
+			if bot.log != nil {
+				pending := persistedPendingAssertion{Assertion: bot.assertion, SequenceNum: bot.sequenceNum, Deadline: next.deadline}
+				state := persistedState{Kind: stateKindWaitingOffchainClosing, SequenceNum: bot.sequenceNum, Deadline: next.deadline}
+				if err := bot.log.CommitTransition(state, &pending, nil); err != nil {
+					return nil, nil, nil, err
+				}
+			}
+			return next, nil, nil, nil
 		}
 	case ethbridge.DisputableAssertionEvent:
 		// Someone proposed a disputable assertion
 		// Unanimous proposal has already been sent
 		return bot, nil, nil, nil
 	case ethbridge.FinalUnanimousAssertEvent:
+		if bot.log != nil {
+			if err := bot.log.WipePendingAssertion(); err != nil {
+				return nil, nil, nil, err
+			}
+		}
 		if bot.retChan != nil {
-			bot.retChan <- false
+			bot.retChan <- UnanimousCloseResult{
+				Outcome: SupersededByFinal,
+				Err:     errors.New("unanimous assertion unexpectedly superseded by final assert"),
+			}
 		}
 		return nil, nil, nil, errors.New("unanimous assertion unexpectedly superseded by final assert")
 	default:
+		if bot.log != nil {
+			if err := bot.log.WipePendingAssertion(); err != nil {
+				return nil, nil, nil, err
+			}
+		}
 		if bot.retChan != nil {
-			bot.retChan <- false
+			bot.retChan <- UnanimousCloseResult{
+				Outcome: Unsynchronized,
+				Err:     errors.New("VM state got unsynchronized"),
+			}
 		}
 		return nil, nil, nil, &Error{nil, "ERROR: waitingAssertDefender: VM state got unsynchronized"}
 	}
@@ -111,16 +173,27 @@ type waitingOffchainClosing struct {
 	*validatorCore
 	assertion *protocol.Assertion
 	deadline  uint64
-	retChan   chan<- bool
+	retChan   chan<- UnanimousCloseResult
+	log       ValidatorLog
+	finalizer L1Finalizer
 }
 
 func (bot waitingOffchainClosing) UpdateTime(time uint64) (validatorState, []valmessage.OutgoingMessage, error) {
 	if time > bot.deadline {
-		return finalizingOffchainClosing{
-				validatorConfig: bot.validatorConfig,
-				validatorCore:   bot.validatorCore,
-				retChan:         bot.retChan,
-			},
+		next := finalizingOffchainClosing{
+			validatorConfig: bot.validatorConfig,
+			validatorCore:   bot.validatorCore,
+			assertion:       bot.assertion,
+			retChan:         bot.retChan,
+			log:             bot.log,
+			finalizer:       bot.finalizer,
+		}
+		if bot.log != nil {
+			if err := bot.log.CommitState(persistedState{Kind: stateKindFinalizingOffchainClosing}, nil); err != nil {
+				return nil, nil, err
+			}
+		}
+		return next,
 			[]valmessage.OutgoingMessage{valmessage.SendConfirmUnanimousAssertedMessage{
 				NewInboxHash: bot.validatorCore.inbox.Receive().Hash(),
 				Assertion:    bot.assertion,
@@ -132,20 +205,45 @@ func (bot waitingOffchainClosing) UpdateTime(time uint64) (validatorState, []val
 }
 
 func (bot waitingOffchainClosing) UpdateState(ev ethbridge.Event, time uint64) (validatorState, challengeState, []valmessage.OutgoingMessage, error) {
-	switch ev.(type) {
+	switch ev := ev.(type) {
 	case ethbridge.ProposedUnanimousAssertEvent:
+		if bot.log != nil {
+			if err := bot.log.WipePendingAssertion(); err != nil {
+				return nil, nil, nil, err
+			}
+		}
 		if bot.retChan != nil {
-			bot.retChan <- false
+			bot.retChan <- UnanimousCloseResult{
+				Outcome:     SupersededBySequence,
+				SequenceNum: ev.SequenceNum,
+				Err:         errors.New("unanimous assertion unexpectedly superseded by sequence number"),
+			}
 		}
 		return nil, nil, nil, errors.New("unanimous assertion unexpectedly superseded by sequence number")
 	case ethbridge.FinalUnanimousAssertEvent:
+		if bot.log != nil {
+			if err := bot.log.WipePendingAssertion(); err != nil {
+				return nil, nil, nil, err
+			}
+		}
 		if bot.retChan != nil {
-			bot.retChan <- false
+			bot.retChan <- UnanimousCloseResult{
+				Outcome: SupersededByFinal,
+				Err:     errors.New("unanimous assertion unexpectedly superseded by final assert"),
+			}
 		}
 		return nil, nil, nil, errors.New("unanimous assertion unexpectedly superseded by final assert")
 	default:
+		if bot.log != nil {
+			if err := bot.log.WipePendingAssertion(); err != nil {
+				return nil, nil, nil, err
+			}
+		}
 		if bot.retChan != nil {
-			bot.retChan <- false
+			bot.retChan <- UnanimousCloseResult{
+				Outcome: Unsynchronized,
+				Err:     errors.New("VM state got unsynchronized"),
+			}
 		}
 		return nil, nil, nil, &Error{nil, "ERROR: waitingAssertDefender: VM state got unsynchronized"}
 	}
@@ -154,7 +252,10 @@ func (bot waitingOffchainClosing) UpdateState(ev ethbridge.Event, time uint64) (
 type finalizingOffchainClosing struct {
 	*validatorConfig
 	*validatorCore
-	retChan chan<- bool
+	assertion *protocol.Assertion
+	retChan   chan<- UnanimousCloseResult
+	log       ValidatorLog
+	finalizer L1Finalizer
 }
 
 func (bot finalizingOffchainClosing) UpdateTime(time uint64) (validatorState, []valmessage.OutgoingMessage, error) {
@@ -162,14 +263,128 @@ func (bot finalizingOffchainClosing) UpdateTime(time uint64) (validatorState, []
 }
 
 func (bot finalizingOffchainClosing) UpdateState(ev ethbridge.Event, time uint64) (validatorState, challengeState, []valmessage.OutgoingMessage, error) {
-	switch ev.(type) {
+	switch ev := ev.(type) {
 	case ethbridge.ConfirmedUnanimousAssertEvent:
-		bot.GetCore().DeliverMessagesToVM()
+		revertDeadline := time + bot.config.GracePeriod
+		next := waitingL1Finality{
+			validatorConfig: bot.validatorConfig,
+			validatorCore:   bot.validatorCore,
+			assertion:       bot.assertion,
+			blockHash:       ev.BlockId.HeaderHash,
+			blockNum:        ev.BlockId.Height.AsInt().Uint64(),
+			revert: waitingOffchainClosing{
+				validatorConfig: bot.validatorConfig,
+				validatorCore:   bot.validatorCore,
+				assertion:       bot.assertion,
+				deadline:        revertDeadline,
+				retChan:         bot.retChan,
+				log:             bot.log,
+				finalizer:       bot.finalizer,
+			},
+			retChan:   bot.retChan,
+			log:       bot.log,
+			finalizer: bot.finalizer,
+		}
+		if bot.log != nil {
+			state := persistedState{
+				Kind:       stateKindWaitingL1Finality,
+				BlockHash:  next.blockHash,
+				BlockNum:   next.blockNum,
+				RevertKind: stateKindWaitingOffchainClosing,
+				Deadline:   revertDeadline,
+			}
+			if err := bot.log.CommitState(state, nil); err != nil {
+				return nil, nil, nil, err
+			}
+		}
 		if bot.retChan != nil {
-			bot.retChan <- true
+			bot.retChan <- UnanimousCloseResult{
+				Outcome:   ConfirmedOnL1,
+				Assertion: bot.assertion,
+				BlockHash: next.blockHash,
+				BlockNum:  next.blockNum,
+			}
 		}
-		return NewWaitingObserver(bot.validatorConfig, bot.validatorCore), nil, nil, nil
+		return next, nil, nil, nil
 	default:
 		return nil, nil, nil, &Error{nil, "ERROR: waitingAssertDefender: VM state got unsynchronized"}
 	}
 }
+
+// waitingL1Finality gates an irrevocably VM-visible action (delivering
+// messages to the VM) behind L1 finality of the block that produced the
+// triggering event, so a reorg can't silently corrupt the VM's inbox
+// after the fact. revert is the state to fall back to if the block is
+// orphaned before it finalizes. With a nil finalizer there is no gate:
+// the first UpdateTime delivers the messages.
+type waitingL1Finality struct {
+	*validatorConfig
+	*validatorCore
+	assertion *protocol.Assertion
+	blockHash common.Hash
+	blockNum  uint64
+	revert    validatorState
+	retChan   chan<- UnanimousCloseResult
+	log       ValidatorLog
+	finalizer L1Finalizer
+}
+
+func (bot waitingL1Finality) UpdateTime(time uint64) (validatorState, []valmessage.OutgoingMessage, error) {
+	if bot.finalizer == nil {
+		return bot.deliver()
+	}
+
+	finalized, err := bot.finalizer.IsBlockFinalized(bot.blockHash, bot.blockNum)
+	if err == ErrBlockOrphaned {
+		if bot.log != nil {
+			// revert's persisted kind must match its concrete type, or a
+			// crash right after this commit would rehydrate the wrong
+			// state machine on restart.
+			var revertState persistedState
+			switch bot.revert.(type) {
+			case attemptingUnanimousClosing:
+				revertState = persistedState{Kind: stateKindAttemptingUnanimousClosing}
+			case waitingOffchainClosing:
+				revertState = persistedState{Kind: stateKindWaitingOffchainClosing}
+			default:
+				return nil, nil, &Error{nil, "ERROR: waitingL1Finality: unexpected revert state type"}
+			}
+			if err := bot.log.CommitState(revertState, nil); err != nil {
+				return nil, nil, err
+			}
+		}
+		return bot.revert, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !finalized {
+		return bot, nil, nil
+	}
+	return bot.deliver()
+}
+
+func (bot waitingL1Finality) deliver() (validatorState, []valmessage.OutgoingMessage, error) {
+	bot.validatorCore.DeliverMessagesToVM()
+	if bot.log != nil {
+		if err := bot.log.WipePendingAssertion(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if bot.retChan != nil {
+		bot.retChan <- UnanimousCloseResult{
+			Outcome:   Confirmed,
+			Assertion: bot.assertion,
+			BlockHash: bot.blockHash,
+			BlockNum:  bot.blockNum,
+		}
+	}
+	return NewWaitingObserver(bot.validatorConfig, bot.validatorCore), nil, nil
+}
+
+func (bot waitingL1Finality) UpdateState(ev ethbridge.Event, time uint64) (validatorState, challengeState, []valmessage.OutgoingMessage, error) {
+	// The unanimous assertion has already been confirmed on L1; we're
+	// only waiting for that confirmation to become irreversible, so no
+	// further bridge events are expected until it does.
+	return bot, nil, nil, nil
+}
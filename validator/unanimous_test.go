@@ -0,0 +1,130 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package validator
+
+import (
+	"testing"
+
+	"github.com/offchainlabs/arb-avm/protocol"
+	"github.com/offchainlabs/arb-util/common"
+	"github.com/offchainlabs/arb-validator/ethbridge"
+)
+
+func TestAttemptingOffchainClosingSupersededBySequence(t *testing.T) {
+	retChan := make(chan UnanimousCloseResult, 1)
+	bot := attemptingOffchainClosing{
+		sequenceNum: 1,
+		retChan:     retChan,
+	}
+
+	if _, _, _, err := bot.UpdateState(ethbridge.ProposedUnanimousAssertEvent{SequenceNum: 2}, 0); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	result := <-retChan
+	if result.Outcome != SupersededBySequence {
+		t.Fatalf("Outcome = %v, want SupersededBySequence", result.Outcome)
+	}
+	if result.SequenceNum != 2 {
+		t.Fatalf("SequenceNum = %d, want 2", result.SequenceNum)
+	}
+}
+
+func TestAttemptingOffchainClosingSupersededByFinal(t *testing.T) {
+	retChan := make(chan UnanimousCloseResult, 1)
+	bot := attemptingOffchainClosing{retChan: retChan}
+
+	if _, _, _, err := bot.UpdateState(ethbridge.FinalUnanimousAssertEvent{}, 0); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	result := <-retChan
+	if result.Outcome != SupersededByFinal {
+		t.Fatalf("Outcome = %v, want SupersededByFinal", result.Outcome)
+	}
+}
+
+func TestAttemptingOffchainClosingSupersededByFinalWipesPendingAssertion(t *testing.T) {
+	log := newTestLog(t)
+	pending := persistedPendingAssertion{Assertion: &protocol.Assertion{}, SequenceNum: 1, Deadline: 10}
+	if err := log.CommitTransition(persistedState{Kind: stateKindAttemptingOffchainClosing}, &pending, nil); err != nil {
+		t.Fatalf("CommitTransition: %v", err)
+	}
+
+	bot := attemptingOffchainClosing{sequenceNum: 1, log: log}
+	if _, _, _, err := bot.UpdateState(ethbridge.FinalUnanimousAssertEvent{}, 0); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if _, ok, err := log.FetchPendingAssertion(nil); err != nil || ok {
+		t.Fatalf("FetchPendingAssertion: ok=%v err=%v, want ok=false", ok, err)
+	}
+}
+
+func TestWaitingL1FinalityConfirmed(t *testing.T) {
+	log := newTestLog(t)
+	pending := persistedPendingAssertion{Assertion: &protocol.Assertion{}}
+	state := persistedState{Kind: stateKindWaitingL1Finality}
+	if err := log.CommitTransition(state, &pending, nil); err != nil {
+		t.Fatalf("CommitTransition: %v", err)
+	}
+
+	retChan := make(chan UnanimousCloseResult, 1)
+	assertion := &protocol.Assertion{}
+	bot := waitingL1Finality{
+		validatorCore: &validatorCore{},
+		assertion:     assertion,
+		blockHash:     common.Hash{1},
+		blockNum:      5,
+		retChan:       retChan,
+		log:           log,
+		finalizer:     &fakeFinalizer{finalized: true},
+	}
+
+	if _, _, err := bot.UpdateTime(0); err != nil {
+		t.Fatalf("UpdateTime: %v", err)
+	}
+
+	result := <-retChan
+	if result.Outcome != Confirmed {
+		t.Fatalf("Outcome = %v, want Confirmed", result.Outcome)
+	}
+	if result.Assertion != assertion {
+		t.Fatalf("Assertion = %v, want %v", result.Assertion, assertion)
+	}
+	if result.BlockHash != bot.blockHash || result.BlockNum != bot.blockNum {
+		t.Fatalf("BlockHash/BlockNum = %v/%d, want %v/%d", result.BlockHash, result.BlockNum, bot.blockHash, bot.blockNum)
+	}
+
+	if _, ok, err := log.FetchPendingAssertion(nil); err != nil || ok {
+		t.Fatalf("FetchPendingAssertion: ok=%v err=%v, want ok=false", ok, err)
+	}
+}
+
+func TestWaitingOffchainClosingUnsynchronized(t *testing.T) {
+	retChan := make(chan UnanimousCloseResult, 1)
+	bot := waitingOffchainClosing{retChan: retChan}
+
+	if _, _, _, err := bot.UpdateState(ethbridge.DisputableAssertionEvent{}, 0); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	result := <-retChan
+	if result.Outcome != Unsynchronized {
+		t.Fatalf("Outcome = %v, want Unsynchronized", result.Outcome)
+	}
+}
@@ -0,0 +1,402 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package validator
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/offchainlabs/arb-avm/protocol"
+	"github.com/offchainlabs/arb-util/common"
+)
+
+var (
+	validatorStateBucket      = []byte("validator-state")
+	validatorPendingAssertion = []byte("validator-pending-assertion")
+
+	validatorStateKey = []byte("current")
+)
+
+// validatorStateKind identifies which concrete validatorState a persisted
+// record reconstitutes into. Only the states that drive an unanimous
+// closing need to survive a crash; WaitingObserver is the implicit
+// zero state when nothing has been persisted yet.
+type validatorStateKind uint8
+
+const (
+	stateKindAttemptingUnanimousClosing validatorStateKind = iota + 1
+	stateKindAttemptingOffchainClosing
+	stateKindWaitingOffchainClosing
+	stateKindFinalizingOffchainClosing
+	stateKindWaitingL1Finality
+)
+
+// persistedState is the on-disk representation of a validatorState. Only
+// the fields relevant to the state kind are populated. For
+// stateKindWaitingL1Finality, RevertKind identifies the concrete type of
+// the in-memory revert field (stateKindAttemptingUnanimousClosing or
+// stateKindWaitingOffchainClosing) so RestoreValidatorState can
+// reconstruct it; Deadline carries the revert's deadline when RevertKind
+// is stateKindWaitingOffchainClosing.
+type persistedState struct {
+	Kind        validatorStateKind
+	SequenceNum uint64
+	Deadline    uint64
+	BlockHash   common.Hash
+	BlockNum    uint64
+	RevertKind  validatorStateKind
+}
+
+// persistedPendingAssertion is the on-disk representation of the
+// assertion a closing state machine is currently driving to confirmation.
+type persistedPendingAssertion struct {
+	Assertion   *protocol.Assertion
+	SequenceNum uint64
+	Deadline    uint64
+}
+
+// ValidatorLogTx is an opaque read transaction handle. Callers that need
+// to make several ValidatorLog calls that should observe a consistent
+// snapshot (for example state + pending assertion + core) can open one
+// with NewReadTx and pass it through, avoiding a fresh transaction per
+// call. Passing a nil ValidatorLogTx tells the method to open and close
+// its own transaction.
+type ValidatorLogTx interface {
+	commit() error
+	rollback() error
+}
+
+// ValidatorLog persists the in-flight state of the unanimous closing state
+// machines so a crashed validator can resume tracking a closing it was
+// already driving, rather than falling back to WaitingObserver and
+// potentially diverging from its peers. It is modeled on lnd's
+// ArbitratorLog.
+type ValidatorLog interface {
+	// NewReadTx opens a read-only transaction that can be passed to
+	// CurrentState and FetchPendingAssertion to batch several lookups
+	// together. CommitState and CommitTransition return an error if
+	// given it, since it cannot be written to.
+	NewReadTx() (ValidatorLogTx, error)
+
+	// CurrentState returns the kind of state machine that was active
+	// when the log was last committed, or ok == false if nothing has
+	// ever been persisted.
+	CurrentState(tx ValidatorLogTx) (state persistedState, ok bool, err error)
+
+	// CommitState atomically persists the given state transition.
+	CommitState(state persistedState, tx ValidatorLogTx) error
+
+	// CommitTransition atomically persists a state transition together
+	// with the pending assertion the new state is driving, in a single
+	// write transaction, so a crash can never observe one updated
+	// without the other. Pass a nil pending to leave the existing
+	// pending-assertion record untouched.
+	CommitTransition(state persistedState, pending *persistedPendingAssertion, tx ValidatorLogTx) error
+
+	// FetchPendingAssertion returns the most recently inserted pending
+	// assertion, or ok == false if there is none.
+	FetchPendingAssertion(tx ValidatorLogTx) (pending persistedPendingAssertion, ok bool, err error)
+
+	// WipePendingAssertion clears the pending assertion record once it
+	// has either been confirmed or definitively abandoned.
+	WipePendingAssertion() error
+
+	// Close releases the underlying store.
+	Close() error
+}
+
+type boltValidatorLogTx struct {
+	tx *bbolt.Tx
+}
+
+func (t *boltValidatorLogTx) commit() error {
+	return t.tx.Commit()
+}
+
+func (t *boltValidatorLogTx) rollback() error {
+	return t.tx.Rollback()
+}
+
+// boltValidatorLog is a ValidatorLog backed by an embedded bbolt database.
+type boltValidatorLog struct {
+	db *bbolt.DB
+}
+
+// NewBoltValidatorLog opens (creating if necessary) a bbolt-backed
+// ValidatorLog at dbPath.
+func NewBoltValidatorLog(dbPath string) (ValidatorLog, error) {
+	db, err := bbolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		return nil, &Error{err, "ValidatorLog: failed to open database"}
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(validatorStateBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(validatorPendingAssertion); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &Error{err, "ValidatorLog: failed to initialize buckets"}
+	}
+	return &boltValidatorLog{db: db}, nil
+}
+
+func (l *boltValidatorLog) NewReadTx() (ValidatorLogTx, error) {
+	tx, err := l.db.Begin(false)
+	if err != nil {
+		return nil, &Error{err, "ValidatorLog: failed to open read transaction"}
+	}
+	return &boltValidatorLogTx{tx: tx}, nil
+}
+
+func (l *boltValidatorLog) CurrentState(tx ValidatorLogTx) (persistedState, bool, error) {
+	var state persistedState
+	found := false
+	readFn := func(btx *bbolt.Tx) error {
+		raw := btx.Bucket(validatorStateBucket).Get(validatorStateKey)
+		if raw == nil {
+			return nil
+		}
+		found = true
+		return gob.NewDecoder(bytes.NewReader(raw)).Decode(&state)
+	}
+
+	var err error
+	if tx != nil {
+		err = readFn(tx.(*boltValidatorLogTx).tx)
+	} else {
+		err = l.db.View(readFn)
+	}
+	if err != nil {
+		return persistedState{}, false, &Error{err, "ValidatorLog: failed to read current state"}
+	}
+	return state, found, nil
+}
+
+func (l *boltValidatorLog) CommitState(state persistedState, tx ValidatorLogTx) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		return &Error{err, "ValidatorLog: failed to encode state"}
+	}
+
+	writeFn := func(btx *bbolt.Tx) error {
+		return btx.Bucket(validatorStateBucket).Put(validatorStateKey, buf.Bytes())
+	}
+
+	var err error
+	if tx != nil {
+		err = writeFn(tx.(*boltValidatorLogTx).tx)
+	} else {
+		err = l.db.Update(writeFn)
+	}
+	if err != nil {
+		return &Error{err, "ValidatorLog: failed to commit state"}
+	}
+	return nil
+}
+
+func (l *boltValidatorLog) CommitTransition(state persistedState, pending *persistedPendingAssertion, tx ValidatorLogTx) error {
+	var stateBuf bytes.Buffer
+	if err := gob.NewEncoder(&stateBuf).Encode(state); err != nil {
+		return &Error{err, "ValidatorLog: failed to encode state"}
+	}
+	var pendingBuf bytes.Buffer
+	if pending != nil {
+		if err := gob.NewEncoder(&pendingBuf).Encode(*pending); err != nil {
+			return &Error{err, "ValidatorLog: failed to encode pending assertion"}
+		}
+	}
+
+	writeFn := func(btx *bbolt.Tx) error {
+		if err := btx.Bucket(validatorStateBucket).Put(validatorStateKey, stateBuf.Bytes()); err != nil {
+			return err
+		}
+		if pending != nil {
+			if err := btx.Bucket(validatorPendingAssertion).Put(validatorStateKey, pendingBuf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var err error
+	if tx != nil {
+		err = writeFn(tx.(*boltValidatorLogTx).tx)
+	} else {
+		err = l.db.Update(writeFn)
+	}
+	if err != nil {
+		return &Error{err, "ValidatorLog: failed to commit transition"}
+	}
+	return nil
+}
+
+func (l *boltValidatorLog) FetchPendingAssertion(tx ValidatorLogTx) (persistedPendingAssertion, bool, error) {
+	var pending persistedPendingAssertion
+	found := false
+	readFn := func(btx *bbolt.Tx) error {
+		raw := btx.Bucket(validatorPendingAssertion).Get(validatorStateKey)
+		if raw == nil {
+			return nil
+		}
+		found = true
+		return gob.NewDecoder(bytes.NewReader(raw)).Decode(&pending)
+	}
+
+	var err error
+	if tx != nil {
+		err = readFn(tx.(*boltValidatorLogTx).tx)
+	} else {
+		err = l.db.View(readFn)
+	}
+	if err != nil {
+		return persistedPendingAssertion{}, false, &Error{err, "ValidatorLog: failed to read pending assertion"}
+	}
+	return pending, found, nil
+}
+
+func (l *boltValidatorLog) WipePendingAssertion() error {
+	err := l.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(validatorPendingAssertion).Delete(validatorStateKey)
+	})
+	if err != nil {
+		return &Error{err, "ValidatorLog: failed to wipe pending assertion"}
+	}
+	return nil
+}
+
+func (l *boltValidatorLog) Close() error {
+	return l.db.Close()
+}
+
+// RestoreValidatorState rehydrates the validatorState that was active when
+// the ValidatorLog was last committed. It returns a fresh WaitingObserver
+// if nothing was ever persisted, so callers can use the result
+// unconditionally on startup. finalizer is threaded into any restored
+// state that gates on L1 finality; it may be nil if the validator wasn't
+// configured with one.
+func RestoreValidatorState(log ValidatorLog, config *validatorConfig, core *validatorCore, finalizer L1Finalizer) (validatorState, error) {
+	tx, err := log.NewReadTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.rollback()
+
+	state, ok, err := log.CurrentState(tx)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return NewWaitingObserver(config, core), nil
+	}
+
+	if state.Kind == stateKindWaitingL1Finality || state.Kind == stateKindFinalizingOffchainClosing {
+		pending, ok, err := log.FetchPendingAssertion(tx)
+		if !ok || err != nil {
+			return NewWaitingObserver(config, core), err
+		}
+		if state.Kind == stateKindFinalizingOffchainClosing {
+			return finalizingOffchainClosing{
+				validatorConfig: config,
+				validatorCore:   core,
+				assertion:       pending.Assertion,
+				retChan:         nil,
+				log:             log,
+				finalizer:       finalizer,
+			}, nil
+		}
+		var revert validatorState
+		switch state.RevertKind {
+		case stateKindAttemptingUnanimousClosing:
+			revert = attemptingUnanimousClosing{
+				validatorConfig: config,
+				validatorCore:   core,
+				assertion:       pending.Assertion,
+				retChan:         nil,
+				log:             log,
+				finalizer:       finalizer,
+			}
+		case stateKindWaitingOffchainClosing:
+			revert = waitingOffchainClosing{
+				validatorConfig: config,
+				validatorCore:   core,
+				assertion:       pending.Assertion,
+				deadline:        state.Deadline,
+				retChan:         nil,
+				log:             log,
+				finalizer:       finalizer,
+			}
+		}
+		return waitingL1Finality{
+			validatorConfig: config,
+			validatorCore:   core,
+			assertion:       pending.Assertion,
+			blockHash:       state.BlockHash,
+			blockNum:        state.BlockNum,
+			revert:          revert,
+			retChan:         nil,
+			log:             log,
+			finalizer:       finalizer,
+		}, nil
+	}
+
+	switch state.Kind {
+	case stateKindWaitingOffchainClosing, stateKindAttemptingOffchainClosing, stateKindAttemptingUnanimousClosing:
+		pending, ok, err := log.FetchPendingAssertion(tx)
+		if !ok || err != nil {
+			return NewWaitingObserver(config, core), err
+		}
+		switch state.Kind {
+		case stateKindWaitingOffchainClosing:
+			return waitingOffchainClosing{
+				validatorConfig: config,
+				validatorCore:   core,
+				assertion:       pending.Assertion,
+				deadline:        pending.Deadline,
+				retChan:         nil,
+				log:             log,
+				finalizer:       finalizer,
+			}, nil
+		case stateKindAttemptingOffchainClosing:
+			return attemptingOffchainClosing{
+				validatorConfig: config,
+				validatorCore:   core,
+				sequenceNum:     pending.SequenceNum,
+				assertion:       pending.Assertion,
+				retChan:         nil,
+				log:             log,
+				finalizer:       finalizer,
+			}, nil
+		default:
+			return attemptingUnanimousClosing{
+				validatorConfig: config,
+				validatorCore:   core,
+				assertion:       pending.Assertion,
+				retChan:         nil,
+				log:             log,
+				finalizer:       finalizer,
+			}, nil
+		}
+	default:
+		return NewWaitingObserver(config, core), nil
+	}
+}
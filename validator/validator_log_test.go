@@ -0,0 +1,210 @@
+/*
+ * Copyright 2019, Offchain Labs, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package validator
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/offchainlabs/arb-avm/protocol"
+	"github.com/offchainlabs/arb-util/common"
+)
+
+// fakeFinalizer lets tests control IsBlockFinalized's result without
+// standing up a real L1 connection.
+type fakeFinalizer struct {
+	finalized bool
+	err       error
+}
+
+func (f *fakeFinalizer) IsBlockFinalized(blockHash common.Hash, blockNum uint64) (bool, error) {
+	return f.finalized, f.err
+}
+
+func (f *fakeFinalizer) WaitForFinality(ctx context.Context, blockNum uint64) <-chan struct{} {
+	done := make(chan struct{})
+	if f.finalized {
+		close(done)
+		return done
+	}
+	go func() {
+		<-ctx.Done()
+		close(done)
+	}()
+	return done
+}
+
+func newTestLog(t *testing.T) ValidatorLog {
+	t.Helper()
+	log, err := NewBoltValidatorLog(filepath.Join(t.TempDir(), "validator.db"))
+	if err != nil {
+		t.Fatalf("NewBoltValidatorLog: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := log.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	})
+	return log
+}
+
+func TestCommitTransitionPersistsStateAndPendingTogether(t *testing.T) {
+	log := newTestLog(t)
+
+	state := persistedState{Kind: stateKindWaitingOffchainClosing, SequenceNum: 3, Deadline: 42}
+	pending := persistedPendingAssertion{Assertion: &protocol.Assertion{}, SequenceNum: 3, Deadline: 42}
+	if err := log.CommitTransition(state, &pending, nil); err != nil {
+		t.Fatalf("CommitTransition: %v", err)
+	}
+
+	gotState, ok, err := log.CurrentState(nil)
+	if err != nil || !ok {
+		t.Fatalf("CurrentState: ok=%v err=%v", ok, err)
+	}
+	if gotState.Kind != state.Kind || gotState.SequenceNum != state.SequenceNum || gotState.Deadline != state.Deadline {
+		t.Fatalf("CurrentState = %+v, want %+v", gotState, state)
+	}
+
+	gotPending, ok, err := log.FetchPendingAssertion(nil)
+	if err != nil || !ok {
+		t.Fatalf("FetchPendingAssertion: ok=%v err=%v", ok, err)
+	}
+	if gotPending.SequenceNum != pending.SequenceNum || gotPending.Deadline != pending.Deadline {
+		t.Fatalf("FetchPendingAssertion = %+v, want %+v", gotPending, pending)
+	}
+}
+
+func TestCommitTransitionNilPendingLeavesExistingPendingUntouched(t *testing.T) {
+	log := newTestLog(t)
+
+	pending := persistedPendingAssertion{Assertion: &protocol.Assertion{}, SequenceNum: 1, Deadline: 10}
+	if err := log.CommitTransition(persistedState{Kind: stateKindWaitingOffchainClosing}, &pending, nil); err != nil {
+		t.Fatalf("CommitTransition: %v", err)
+	}
+
+	if err := log.CommitTransition(persistedState{Kind: stateKindFinalizingOffchainClosing}, nil, nil); err != nil {
+		t.Fatalf("CommitTransition: %v", err)
+	}
+
+	gotPending, ok, err := log.FetchPendingAssertion(nil)
+	if err != nil || !ok {
+		t.Fatalf("FetchPendingAssertion: ok=%v err=%v", ok, err)
+	}
+	if gotPending.SequenceNum != pending.SequenceNum || gotPending.Deadline != pending.Deadline {
+		t.Fatalf("pending assertion should be untouched, got %+v", gotPending)
+	}
+}
+
+func TestRestoreValidatorStateThreadsFinalizerThroughEveryPersistedKind(t *testing.T) {
+	config := &validatorConfig{}
+	core := &validatorCore{}
+	finalizer := &trustedConfirmationsFinalizer{}
+
+	cases := []persistedState{
+		{Kind: stateKindWaitingOffchainClosing, Deadline: 5},
+		{Kind: stateKindAttemptingOffchainClosing},
+		{Kind: stateKindAttemptingUnanimousClosing},
+		{Kind: stateKindFinalizingOffchainClosing},
+		{Kind: stateKindWaitingL1Finality},
+	}
+
+	for _, state := range cases {
+		log := newTestLog(t)
+		pending := persistedPendingAssertion{Assertion: &protocol.Assertion{}}
+		if err := log.CommitTransition(state, &pending, nil); err != nil {
+			t.Fatalf("CommitTransition: %v", err)
+		}
+
+		restored, err := RestoreValidatorState(log, config, core, finalizer)
+		if err != nil {
+			t.Fatalf("RestoreValidatorState(kind=%d): %v", state.Kind, err)
+		}
+
+		var gotFinalizer L1Finalizer
+		switch s := restored.(type) {
+		case waitingOffchainClosing:
+			gotFinalizer = s.finalizer
+		case attemptingOffchainClosing:
+			gotFinalizer = s.finalizer
+		case attemptingUnanimousClosing:
+			gotFinalizer = s.finalizer
+		case finalizingOffchainClosing:
+			gotFinalizer = s.finalizer
+		case waitingL1Finality:
+			gotFinalizer = s.finalizer
+		default:
+			t.Fatalf("RestoreValidatorState(kind=%d) returned unexpected type %T", state.Kind, restored)
+		}
+		if gotFinalizer != finalizer {
+			t.Errorf("RestoreValidatorState(kind=%d): finalizer not threaded through restored %T state", state.Kind, restored)
+		}
+	}
+}
+
+func TestRestoreValidatorStateWaitingL1FinalityRevertsOnOrphan(t *testing.T) {
+	log := newTestLog(t)
+	config := &validatorConfig{}
+	core := &validatorCore{}
+
+	pending := persistedPendingAssertion{Assertion: &protocol.Assertion{}, SequenceNum: 7, Deadline: 99}
+	state := persistedState{
+		Kind:       stateKindWaitingL1Finality,
+		RevertKind: stateKindWaitingOffchainClosing,
+		Deadline:   99,
+	}
+	if err := log.CommitTransition(state, &pending, nil); err != nil {
+		t.Fatalf("CommitTransition: %v", err)
+	}
+
+	finalizer := &fakeFinalizer{err: ErrBlockOrphaned}
+	restored, err := RestoreValidatorState(log, config, core, finalizer)
+	if err != nil {
+		t.Fatalf("RestoreValidatorState: %v", err)
+	}
+	bot, ok := restored.(waitingL1Finality)
+	if !ok {
+		t.Fatalf("RestoreValidatorState returned %T, want waitingL1Finality", restored)
+	}
+
+	reverted, _, err := bot.UpdateTime(0)
+	if err != nil {
+		t.Fatalf("UpdateTime: %v", err)
+	}
+	offchain, ok := reverted.(waitingOffchainClosing)
+	if !ok {
+		t.Fatalf("UpdateTime after orphan returned %T, want waitingOffchainClosing", reverted)
+	}
+	if offchain.deadline != pending.Deadline {
+		t.Fatalf("offchain.deadline = %d, want %d", offchain.deadline, pending.Deadline)
+	}
+}
+
+func TestRestoreValidatorStateWithNothingPersistedReturnsWaitingObserver(t *testing.T) {
+	log := newTestLog(t)
+	config := &validatorConfig{}
+	core := &validatorCore{}
+
+	restored, err := RestoreValidatorState(log, config, core, nil)
+	if err != nil {
+		t.Fatalf("RestoreValidatorState: %v", err)
+	}
+	want := NewWaitingObserver(config, core)
+	if restored != want {
+		t.Fatalf("RestoreValidatorState = %#v, want a fresh WaitingObserver %#v", restored, want)
+	}
+}